@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// logThrottle logs a message at most once per interval for each key, so that
+// an outage does not flood the logs. The number of suppressed messages is
+// reported with the next one logged.
+type logThrottle struct {
+	interval time.Duration // 0 logs everything
+
+	mu   sync.Mutex
+	keys map[string]*throttled
+}
+
+type throttled struct {
+	last       time.Time
+	suppressed int
+}
+
+func newLogThrottle(interval time.Duration) *logThrottle {
+	return &logThrottle{interval: interval, keys: make(map[string]*throttled)}
+}
+
+func (t *logThrottle) log(key string, level slog.Level, msg string, args ...any) {
+	if t.interval > 0 {
+		now := time.Now()
+		t.mu.Lock()
+		k := t.keys[key]
+		if k == nil {
+			k = &throttled{}
+			t.keys[key] = k
+		}
+		if now.Sub(k.last) < t.interval {
+			k.suppressed++
+			t.mu.Unlock()
+			return
+		}
+		if k.suppressed > 0 {
+			args = append(args, "suppressed", k.suppressed)
+		}
+		k.last = now
+		k.suppressed = 0
+		t.mu.Unlock()
+	}
+	slog.Log(context.Background(), level, msg, args...)
+}
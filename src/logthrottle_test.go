@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureHandler records the logged records
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+// attr returns the value of the attribute key of the record i
+func (h *captureHandler) attr(i int, key string) (slog.Value, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var v slog.Value
+	var ok bool
+	h.records[i].Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			v, ok = a.Value, true
+			return false
+		}
+		return true
+	})
+	return v, ok
+}
+
+// find returns the index of the first record with msg, -1 if none
+func (h *captureHandler) find(msg string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, r := range h.records {
+		if r.Message == msg {
+			return i
+		}
+	}
+	return -1
+}
+
+// count returns the number of records with msg
+func (h *captureHandler) count(msg string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, r := range h.records {
+		if r.Message == msg {
+			n++
+		}
+	}
+	return n
+}
+
+func captureLogs(t *testing.T) *captureHandler {
+	h := &captureHandler{}
+	old := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return h
+}
+
+func TestLogThrottle(t *testing.T) {
+	h := captureLogs(t)
+	lt := newLogThrottle(50 * time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		lt.log("dial a", slog.LevelError, "Dial failed", "addr", "a")
+	}
+	lt.log("dial b", slog.LevelError, "Dial failed", "addr", "b")
+	if len(h.records) != 2 {
+		t.Fatalf("got %d records, want 2 (one per key)", len(h.records))
+	}
+	if _, ok := h.attr(0, "suppressed"); ok {
+		t.Error("suppressed reported on the first record")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	lt.log("dial a", slog.LevelError, "Dial failed", "addr", "a")
+	if len(h.records) != 3 {
+		t.Fatalf("got %d records, want 3", len(h.records))
+	}
+	v, ok := h.attr(2, "suppressed")
+	if !ok || v.Int64() != 3 {
+		t.Errorf("got suppressed=%v, want 3", v)
+	}
+
+	// The count starts over once reported
+	time.Sleep(60 * time.Millisecond)
+	lt.log("dial a", slog.LevelError, "Dial failed", "addr", "a")
+	if _, ok := h.attr(3, "suppressed"); ok {
+		t.Error("suppressed reported again")
+	}
+}
+
+func TestLogThrottleDisabled(t *testing.T) {
+	h := captureLogs(t)
+	lt := newLogThrottle(0)
+	for i := 0; i < 3; i++ {
+		lt.log("dial a", slog.LevelError, "Dial failed")
+	}
+	if len(h.records) != 3 {
+		t.Errorf("got %d records, want 3", len(h.records))
+	}
+}
@@ -1,53 +1,165 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
+	"math/rand"
 	"net"
 	"os"
 	"runtime"
-	"strings"
+	"runtime/debug"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var (
-	probePeriod = flag.Duration("probe-period", 2*time.Second, "Probe period")
-	verbose     = flag.Bool("verbose", false, "Verbose mode")
-)
+// Config holds the settings shared by all the mappings, bound to the command line flags in main()
+type Config struct {
+	ProbePeriod     time.Duration
+	ProbeMaxBackoff time.Duration // max probe period while lookups fail
+	ProbeJitter     float64       // random spread of the probe period, 0.1 for +/-10%
+	DNSWait         time.Duration // wait for the first resolution before accepting, 0 to not wait
+	DNSTimeout      time.Duration // lookup timeout, 0 for the resolver default
+	Verbose         bool
+	Validate        bool
+
+	TCPKeepAlive time.Duration // 0 disables keepalive
+	TCPNoDelay   bool          // disable Nagle's algorithm
+	HalfClose    bool          // forward EOF with CloseWrite instead of closing both sides
+
+	BindRetries    int           // retries when a listen port is busy
+	BindRetryDelay time.Duration // first retry delay, doubled on each retry up to 1s
+	BindOptional   bool          // skip a listener that cannot bind instead of failing
+	ReusePort      bool          // SO_REUSEPORT, to run several instances on the same ports
 
-func PrintMemUsage() {
+	ErrorLogInterval time.Duration // repeated errors are logged once per interval
+	SourceIP         net.IP        // local address of the backend connections, nil for any
+	DialCooldown     time.Duration // a static backend that failed to dial is skipped for this long
+
+	activated int          // sockets passed by systemd socket activation, from fd 3
+	lookup    lookupFunc   // nil for net.DefaultResolver
+	logs      *logThrottle // for the errors logged on each connection
+	penalties *penaltyBox  // backends that recently failed to dial
+	stats     stats
+}
+
+// stats are the counters printed in verbose mode
+type stats struct {
+	openConns   atomic.Int64 // currently forwarded connections
+	peakConns   atomic.Int64 // high-water mark of openConns
+	panics      atomic.Int64 // recovered connection goroutines
+	dnsTimeouts atomic.Int64
+}
+
+// connOpened counts a new connection and raises the peak if needed
+func (s *stats) connOpened() {
+	n := s.openConns.Add(1)
+	for {
+		peak := s.peakConns.Load()
+		if n <= peak || s.peakConns.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+func (s *stats) PrintMemUsage(w io.Writer) {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 	// For info on each, see: https://golang.org/pkg/runtime/#MemStats
-	fmt.Printf("GoRoutine=%v", runtime.NumGoroutine())
-	fmt.Printf("\tAlloc=%v KiB", m.Alloc/1024)
-	fmt.Printf("\tTotalAlloc=%v KiB", m.TotalAlloc/1024)
-	fmt.Printf("\tSys=%v KiB", m.Sys/1024)
-	fmt.Printf("\tNumGC=%v\n", m.NumGC)
+	fmt.Fprintf(w, "GoRoutine=%v", runtime.NumGoroutine())
+	fmt.Fprintf(w, "\tAlloc=%v KiB", m.Alloc/1024)
+	fmt.Fprintf(w, "\tTotalAlloc=%v KiB", m.TotalAlloc/1024)
+	fmt.Fprintf(w, "\tSys=%v KiB", m.Sys/1024)
+	fmt.Fprintf(w, "\tNumGC=%v", m.NumGC)
+	fmt.Fprintf(w, "\tOpenConns=%v", s.openConns.Load())
+	fmt.Fprintf(w, "\tPeakConns=%v", s.peakConns.Load())
+	fmt.Fprintf(w, "\tPanics=%v", s.panics.Load())
+	fmt.Fprintf(w, "\tDNSTimeouts=%v\n", s.dnsTimeouts.Load())
+}
+
+// printStats prints the memory usage and the counters every period, even
+// without any host to probe
+func printStats(s *stats, w io.Writer, period time.Duration) {
+	for range time.Tick(period) {
+		s.PrintMemUsage(w)
+	}
+}
+
+// lookupFunc resolves a host like net.Resolver.LookupIPAddr
+type lookupFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// lookupIP resolves host, giving up after cfg.DNSTimeout so that a stuck
+// resolver does not stall the probe loop
+func lookupIP(cfg *Config, host string) ([]net.IP, error) {
+	ctx := context.Background()
+	if cfg.DNSTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.DNSTimeout)
+		defer cancel()
+	}
+	lookup := cfg.lookup
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIPAddr
+	}
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		if ctx.Err() != nil {
+			cfg.stats.dnsTimeouts.Add(1)
+		}
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
 }
 
-func dnsProbe(host string) {
+// jitter spreads d randomly by +/- fraction, keeping d on average
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d + time.Duration(fraction*(2*rand.Float64()-1)*float64(d))
+}
+
+func dnsProbe(cfg *Config, host string) {
 	slog.Info("Resolving", "host", host)
 	m := make(map[string]int)
 	round := 0
+	failures := 0
+	delay := cfg.ProbePeriod
 	for {
-		time.Sleep(*probePeriod)
+		time.Sleep(jitter(delay, cfg.ProbeJitter))
 		round++
 
-		if *verbose {
-			PrintMemUsage()
+		if cfg.Verbose {
 			slog.Info("Probing...", "host", host)
 		}
 
-		ips, err := net.LookupIP(host)
+		ips, err := lookupIP(cfg, host)
 		if err != nil {
-			slog.Error("Lookup failed", "host", host, "err", err)
+			// Keep the last known IPs, back off and only log the first failure
+			failures++
+			if failures == 1 {
+				slog.Error("Lookup failed", "host", host, "err", err)
+			} else if cfg.Verbose {
+				slog.Warn("Lookup still failing", "host", host, "failures", failures, "err", err)
+			}
+			delay = min(2*delay, max(cfg.ProbeMaxBackoff, cfg.ProbePeriod))
 			continue
 		}
+		if failures > 0 {
+			slog.Info("Lookup recovered", "host", host, "failures", failures)
+			failures = 0
+			delay = cfg.ProbePeriod
+		}
 
 		for _, ip := range ips {
 			if m[ip.String()] == 0 {
@@ -65,93 +177,465 @@ func dnsProbe(host string) {
 	}
 }
 
-func forward(c net.Conn, addr string, port string) {
+// dialer returns the dialer for backend connections, bound to the source IP
+func (cfg *Config) dialer(network string) *net.Dialer {
+	var d net.Dialer
+	if cfg.SourceIP != nil && network == "tcp" {
+		d.LocalAddr = &net.TCPAddr{IP: cfg.SourceIP}
+	}
+	return &d
+}
+
+// setTCPOptions applies the keepalive and Nagle settings to TCP connections
+func setTCPOptions(cfg *Config, c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(cfg.TCPNoDelay)
+	if cfg.TCPKeepAlive <= 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(cfg.TCPKeepAlive)
+}
+
+// closeWrite shuts down the writing side of a connection, telling the peer
+// no more data will come while still reading its reply
+func closeWrite(c net.Conn) bool {
+	cw, ok := c.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
+
+// recoverConn logs a panic of a connection goroutine instead of crashing
+// the whole LB, then calls cleanup if not nil. It must be deferred directly.
+func (cfg *Config) recoverConn(port string, c net.Conn, cleanup func()) {
+	if r := recover(); r != nil {
+		slog.Error("Panic while forwarding", "port", port, "client", c.RemoteAddr(), "panic", r, "panics", cfg.stats.panics.Add(1), "stack", string(debug.Stack()))
+		if cleanup != nil {
+			cleanup()
+		}
+	}
+}
+
+func forward(cfg *Config, c net.Conn, m *mapping) {
 	defer c.Close()
+	defer cfg.recoverConn(m.listen, c, nil)
+	cfg.stats.connOpened()
+	defer cfg.stats.openConns.Add(-1)
+	setTCPOptions(cfg, c)
 
+	port := m.listen
+	addr := m.backend(cfg.penalties)
 	// Connect to the remote server
-	remote, err := net.Dial("tcp", addr)
+	network, address := m.dialArgs(addr)
+	remote, err := cfg.dialer(network).Dial(network, address)
 	if err != nil {
-		slog.Error("Dial failed", "addr", addr, "err", err)
+		if len(m.static) > 1 {
+			// Only worth remembering when there is another backend to pick
+			cfg.penalties.fail(addr)
+		}
+		cfg.logs.log("dial "+addr, slog.LevelError, "Dial failed", "addr", addr, "err", err)
 		return
 	}
 	defer remote.Close()
+	setTCPOptions(cfg, remote)
 
 	slog.Info("Forwarding", "port", port, "remote", remote.RemoteAddr())
 
+	// Bytes are counted from the LB point of view:
+	// received from the client, sent to the client
 	var closed atomic.Bool
+	// closeBoth unblocks both directions
+	closeBoth := func() {
+		closed.Store(true)
+		c.Close()
+		remote.Close()
+	}
+	receivedc := make(chan int64, 1)
 	// Run in parallel to prevent blocking
 	go func() {
-		defer c.Close()
+		var received int64
+		defer func() { receivedc <- received }()
+		// Unblock the other direction, or forward() would wait forever
+		defer cfg.recoverConn(port, c, closeBoth)
 		// Copy the data from the client to the remote server
-		_, err := io.Copy(remote, c)
+		var err error
+		received, err = io.Copy(remote, c)
 		if err != nil && closed.Load() == false {
 			slog.Error("Connection error", "remote", remote.RemoteAddr(), "addr", addr, "err", err)
 		}
-		closed.Store(true)
+		if err == nil && cfg.HalfClose && closeWrite(remote) {
+			// The client is done sending, let the backend finish its reply
+			return
+		}
+		closeBoth()
 	}()
 
 	// Copy the data from the remote server to the client
-	_, err = io.Copy(c, remote)
+	sent, err := io.Copy(c, remote)
 	if err != nil && closed.Load() == false {
 		slog.Error("Connection error", "remote", remote.RemoteAddr(), "addr", addr, "err", err)
 	}
-	closed.Store(true)
+	if err != nil || !cfg.HalfClose || !closeWrite(c) {
+		closeBoth()
+	}
+
+	// Wait for the other direction before reporting
+	received := <-receivedc
+	closeBoth()
+	slog.Info("Closed", "port", port, "remote", remote.RemoteAddr(), "sent", sent, "received", received)
+}
+
+// sourceIP returns the client IP of an accepted connection
+func sourceIP(c net.Conn) net.IP {
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return a.IP
+	}
+	return nil
+}
+
+// isTemporary tells whether an accept error may go away by itself
+func isTemporary(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNRESET)
 }
 
-func listenAndForward(port string, addr string) {
-	slog.Info("Forwarding", "port", port, "addr", addr)
+func listen(cfg *Config, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if cfg.ReusePort {
+		lc.Control = reusePort
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
 
-	l, err := net.Listen("tcp", ":"+port)
+// inheritListener wraps a listening socket passed by the parent process
+func inheritListener(fd int) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), "fd"+strconv.Itoa(fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+	l, err := net.FileListener(f)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+	}
+	return l, nil
+}
+
+// listenFDs returns the number of sockets passed by systemd socket activation,
+// starting at fd 3
+func listenFDs() int {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return n
+}
+
+// listenRetry retries to bind while the port is in use, e.g. by a previous
+// process still shutting down
+func listenRetry(cfg *Config, addr string) (net.Listener, error) {
+	delay := cfg.BindRetryDelay
+	for i := 0; ; i++ {
+		l, err := listen(cfg, addr)
+		if err == nil || i >= cfg.BindRetries || !errors.Is(err, syscall.EADDRINUSE) {
+			return l, err
+		}
+		slog.Warn("Bind failed, retrying", "addr", addr, "delay", delay, "err", err)
+		time.Sleep(delay)
+		// Capped like the accept loop, so that many retries do not wait for days
+		delay = min(2*delay, max(time.Second, cfg.BindRetryDelay))
+	}
+}
+
+// waitResolved waits until host resolves, for at most timeout
+func waitResolved(cfg *Config, host string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := lookupIP(cfg, host); err == nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			slog.Warn("Host not resolved in time, starting anyway", "host", host, "timeout", timeout)
+			return false
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// acceptAndForward accepts connections once ready returns, a nil ready
+// accepts at once. Until then, clients wait in the listen backlog.
+func acceptAndForward(cfg *Config, l net.Listener, m *mapping, ready func() bool) {
+	slog.Info("Forwarding", "port", m.listen, "addr", m)
+
+	// One slot per open connection when the listener is capped
+	var slots chan struct{}
+	if m.maxConns > 0 {
+		slots = make(chan struct{}, m.maxConns)
+	}
+	var limiter *rateLimiter
+	if m.rate > 0 {
+		limiter = newRateLimiter(m.rate, m.burst, maxRateSources)
+	}
+	var rejected, denied, throttled atomic.Int64
+	var queued atomic.Int64 // connections waiting for a slot
+
+	serve := func(conn net.Conn) {
+		defer func() { <-slots }()
+		forward(cfg, conn, m)
+	}
+	// wait waits a bounded time for a slot to free up
+	wait := func(conn net.Conn) {
+		timer := time.NewTimer(m.queueTimeout)
+		defer timer.Stop()
+		select {
+		case slots <- struct{}{}:
+			queued.Add(-1)
+			serve(conn)
+		case <-timer.C:
+			conn.Close()
+			cfg.logs.log("rejected "+m.listen, slog.LevelWarn, "Too many connections, rejected after waiting", "port", m.listen, "max", m.maxConns, "queued", queued.Add(-1), "rejected", rejected.Add(1))
+		}
 	}
 
 	go func() {
 		defer l.Close()
+		if ready != nil {
+			ready()
+		}
+		var delay time.Duration
 		for {
 			// Wait for a connection.
 			conn, err := l.Accept()
 			if err != nil {
-				log.Fatal(err)
+				if !isTemporary(err) {
+					slog.Error("Accept failed, stopping listener", "port", m.listen, "err", err)
+					return
+				}
+				// Back off like net/http does, so that running out of
+				// file descriptors does not spin the loop
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				slog.Warn("Accept failed, retrying", "port", m.listen, "delay", delay, "err", err)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+			// Checked even without an IP, so that an allow list fails closed
+			ip := sourceIP(conn)
+			if !m.allowed(ip) {
+				conn.Close()
+				cfg.logs.log("denied "+m.listen, slog.LevelWarn, "Source not allowed, denied", "port", m.listen, "ip", ip, "denied", denied.Add(1))
+				continue
+			}
+			if ip != nil && limiter != nil && !limiter.allow(ip.String(), time.Now()) {
+				conn.Close()
+				cfg.logs.log("throttled "+m.listen, slog.LevelWarn, "Source rate limited, throttled", "port", m.listen, "ip", ip, "throttled", throttled.Add(1))
+				continue
+			}
+			if slots == nil {
+				// Handle the connection in a new goroutine.
+				// The loop then returns to accepting, so that
+				// multiple connections may be served concurrently.
+				go forward(cfg, conn, m)
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+				go serve(conn)
+			default:
+				// Only this loop adds to the queue, so the check cannot race
+				if m.queueTimeout > 0 && queued.Load() < int64(m.queueSize) {
+					queued.Add(1)
+					go wait(conn)
+					continue
+				}
+				conn.Close()
+				cfg.logs.log("rejected "+m.listen, slog.LevelWarn, "Too many connections, rejected", "port", m.listen, "max", m.maxConns, "rejected", rejected.Add(1))
 			}
-			// Handle the connection in a new goroutine.
-			// The loop then returns to accepting, so that
-			// multiple connections may be served concurrently.
-			go forward(conn, addr, port)
 		}
 	}()
 }
 
-func smain(args []string) {
+// smain checks the configuration and starts the listeners, the validate
+// report and the verbose stats are printed to out
+func smain(cfg *Config, args []string, out io.Writer) error {
+	mappings, err := parseMappings(args)
+	if err != nil {
+		return err
+	}
+
+	if cfg.ProbeJitter < 0 || cfg.ProbeJitter >= 1 {
+		return fmt.Errorf("invalid probe jitter %v, expected [0, 1)", cfg.ProbeJitter)
+	}
+	if cfg.BindRetries < 0 || cfg.BindRetries > 0 && cfg.BindRetryDelay <= 0 {
+		return fmt.Errorf("invalid bind retries %d with a delay of %v", cfg.BindRetries, cfg.BindRetryDelay)
+	}
+	// Socket activated listeners are given in mapping order, skipping
+	// the ones already taken by an explicit fd=
+	if n := cfg.activated; n > 0 {
+		used := make(map[int]bool)
+		for _, m := range mappings {
+			used[m.fd] = true
+		}
+		fd := 3
+		for i := range mappings {
+			for used[fd] {
+				fd++
+			}
+			if fd >= 3+n {
+				break
+			}
+			if mappings[i].fd == 0 {
+				mappings[i].fd = fd
+				fd++
+			}
+		}
+	}
+
+	if cfg.Validate {
+		for _, m := range mappings {
+			if m.fd > 0 {
+				fmt.Fprintf(out, "Listener fd %d -> %s\n", m.fd, m)
+				continue
+			}
+			fmt.Fprintf(out, "Listener %s -> %s\n", m.listenAddr(), m)
+		}
+		return nil
+	}
+
+	if cfg.SourceIP != nil {
+		// Make sure the address belongs to this host, not in validate mode as it binds
+		l, err := net.Listen("tcp", net.JoinHostPort(cfg.SourceIP.String(), "0"))
+		if err != nil {
+			return fmt.Errorf("source IP %v is not assignable: %w", cfg.SourceIP, err)
+		}
+		l.Close()
+	}
+
+	// Bind every port before forwarding anything, so that a bad port
+	// does not leave the other listeners half started
+	listeners := make([]net.Listener, len(mappings))
+	bindErrs := make([]error, len(mappings))
+	var wg sync.WaitGroup
+	for i, m := range mappings {
+		wg.Add(1)
+		if m.fd > 0 {
+			listeners[i], bindErrs[i] = inheritListener(m.fd)
+			wg.Done()
+			continue
+		}
+		go func(i int, addr string) {
+			defer wg.Done()
+			listeners[i], bindErrs[i] = listenRetry(cfg, addr)
+		}(i, m.listenAddr())
+	}
+	wg.Wait()
+	var errs []error
+	for i, err := range bindErrs {
+		if err == nil {
+			continue
+		}
+		if cfg.BindOptional {
+			slog.Error("Bind failed, skipping listener", "addr", mappings[i].listenAddr(), "err", err)
+			continue
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		for _, l := range listeners {
+			if l != nil {
+				l.Close()
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	cfg.logs = newLogThrottle(cfg.ErrorLogInterval)
+	cfg.penalties = newPenaltyBox(cfg.DialCooldown)
+
 	hosts := make(map[string]bool)
-	for i, arg := range args {
-		// fmt.Println(arg)
-		mappings := strings.Split(arg, ":")
-		var porti, host, port string
-		if len(mappings) == 3 {
-			porti = mappings[0]
-			host = mappings[1]
-			port = mappings[2]
-		} else if len(mappings) == 2 {
-			porti = mappings[1]
-			host = mappings[0]
-			port = mappings[1]
-		} else {
-			log.Fatal("arg", i, arg, "is not in proti:host:port or host:port format")
-		}
-
-		addr := host + ":" + port
-		listenAndForward(porti, addr)
-		if !hosts[host] {
-			hosts[host] = true
-			slog.Info("Starting DNS probe", "host", host)
-			go dnsProbe(host)
+	resolved := make(map[string]func() bool)
+	for i := range mappings {
+		if listeners[i] == nil {
+			continue
+		}
+		m := &mappings[i]
+		dns := m.network == "tcp" && m.host != ""
+		var ready func() bool
+		if dns && cfg.DNSWait > 0 {
+			// Shared by all the listeners of the same host
+			if resolved[m.host] == nil {
+				host := m.host
+				resolved[host] = sync.OnceValue(func() bool { return waitResolved(cfg, host, cfg.DNSWait) })
+			}
+			ready = resolved[m.host]
 		}
+		acceptAndForward(cfg, listeners[i], m, ready)
+		if dns && !hosts[m.host] {
+			hosts[m.host] = true
+			slog.Info("Starting DNS probe", "host", m.host)
+			go dnsProbe(cfg, m.host)
+		}
+	}
+	if cfg.Verbose {
+		go printStats(&cfg.stats, out, cfg.ProbePeriod)
 	}
 	slog.Info("Running...")
+	return nil
 }
 
 func main() {
+	var cfg Config
+	flag.DurationVar(&cfg.ProbePeriod, "probe-period", 2*time.Second, "Probe period")
+	flag.Float64Var(&cfg.ProbeJitter, "probe-jitter", 0.1, "Random spread of the probe period, as a fraction of it (0.1 for +/-10%)")
+	flag.DurationVar(&cfg.ProbeMaxBackoff, "probe-max-backoff", 30*time.Second, "Max probe period while lookups keep failing")
+	flag.DurationVar(&cfg.DNSTimeout, "dns-timeout", 5*time.Second, "DNS lookup timeout (0 for the resolver default)")
+	flag.DurationVar(&cfg.DNSWait, "dns-wait", 0, "Max time to wait for a host to resolve before accepting its connections (0 to not wait)")
+	flag.Func("source-ip", "Local IP of the backend connections, for multi-homed hosts", func(s string) error {
+		cfg.SourceIP = net.ParseIP(s)
+		if cfg.SourceIP == nil {
+			return fmt.Errorf("invalid IP %q", s)
+		}
+		return nil
+	})
+	flag.DurationVar(&cfg.DialCooldown, "dial-cooldown", 5*time.Second, "Skip a static backend for this long after it failed to dial, unless all are failing (0 to disable)")
+	flag.DurationVar(&cfg.ErrorLogInterval, "error-log-interval", 5*time.Second, "Log repeated connection errors (dial failures, rejections) once per interval (0 to log them all)")
+	flag.BoolVar(&cfg.Verbose, "verbose", false, "Verbose mode")
+	flag.BoolVar(&cfg.Validate, "validate", false, "Validate the mappings and exit without listening")
+	flag.IntVar(&cfg.BindRetries, "bind-retries", 0, "Number of retries when a listen port is already in use")
+	flag.DurationVar(&cfg.BindRetryDelay, "bind-retry-delay", 500*time.Millisecond, "Delay before the first bind retry, doubled on each retry up to 1s (or this delay if longer)")
+	flag.BoolVar(&cfg.BindOptional, "bind-optional", false, "Skip the listeners that cannot bind instead of exiting")
+	flag.BoolVar(&cfg.ReusePort, "reuseport", false, "Set SO_REUSEPORT on the listeners (Linux/BSD), to run several instances on the same ports")
+	flag.BoolVar(&cfg.TCPNoDelay, "tcp-nodelay", true, "Disable Nagle's algorithm on client and backend connections: lower latency for small writes, more packets for bulk transfers")
+	flag.BoolVar(&cfg.HalfClose, "half-close", false, "Forward an EOF as a half-close, letting the other direction drain before closing the connection")
+	flag.DurationVar(&cfg.TCPKeepAlive, "tcp-keepalive", 15*time.Second, "TCP keepalive period on client and backend connections (0 to disable)")
+
 	flag.Usage = func() {
 		flagSet := flag.CommandLine
 		fmt.Printf("Usage of %s: %s\n", os.Args[0], "<port:host:port...>")
@@ -165,7 +649,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	smain(flag.Args())
+	cfg.activated = listenFDs()
+	if err := smain(&cfg, flag.Args(), os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if cfg.Validate {
+		fmt.Println("Configuration OK")
+		return
+	}
 
 	c := make(chan int)
 	<-c
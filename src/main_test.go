@@ -0,0 +1,676 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSmainValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(*Config)
+		activated int // LISTEN_FDS
+		args      []string
+		want      string // printed report
+		err       string // expected error substring, empty for none
+	}{
+		{
+			name: "mixed",
+			args: []string{"8080:service1:8081", "127.0.0.1:80;81:unix:/s.sock", "9000,static=10.0.0.1;10.0.0.2:90", "s2:7000"},
+			want: "Listener :8080 -> service1:8081\n" +
+				"Listener 127.0.0.1:80 -> unix:/s.sock\n" +
+				"Listener 127.0.0.1:81 -> unix:/s.sock\n" +
+				"Listener :9000 -> static=10.0.0.1:9000;10.0.0.2:90\n" +
+				"Listener :7000 -> s2:7000\n",
+		},
+		{
+			name:      "socket activation skips explicit fds",
+			activated: 3,
+			args:      []string{"80:s:1", "81:s:1,fd=3", "82:s:1", "83:s:1"},
+			want: "Listener fd 4 -> s:1\n" +
+				"Listener fd 3 -> s:1\n" +
+				"Listener fd 5 -> s:1\n" +
+				"Listener :83 -> s:1\n",
+		},
+		{name: "invalid mapping", args: []string{"8080:s:1", "8081"}, err: "arg 1:"},
+		{name: "bind retries without delay", setup: func(c *Config) { c.BindRetries = 3 }, args: []string{"8080:s:1"}, err: "invalid bind retries"},
+		{name: "negative bind retries", setup: func(c *Config) { c.BindRetries = -1; c.BindRetryDelay = time.Second }, args: []string{"8080:s:1"}, err: "invalid bind retries"},
+		{name: "invalid jitter", setup: func(c *Config) { c.ProbeJitter = 1 }, args: []string{"8080:s:1"}, err: "invalid probe jitter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Validate: true, activated: tt.activated}
+			if tt.setup != nil {
+				tt.setup(cfg)
+			}
+			var out strings.Builder
+			err := smain(cfg, tt.args, &out)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got report\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+// freePort returns a port that was just free on the loopback
+func freePort(t testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func TestSmainBindErrors(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free := "127.0.0.1:" + freePort(t)
+
+	cfg := &Config{}
+	err = smain(cfg, []string{busy.Addr().String() + ":s:1", free + ":s:1"}, io.Discard)
+	if !errors.Is(err, syscall.EADDRINUSE) || !strings.Contains(err.Error(), busy.Addr().String()) {
+		t.Fatalf("got error %v, want %s in use", err, busy.Addr())
+	}
+	// The listener that did bind is closed again
+	l, err := net.Listen("tcp", free)
+	if err != nil {
+		t.Fatalf("listener on %s left open: %v", free, err)
+	}
+	l.Close()
+}
+
+func TestListenRetry(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := busy.Addr().String()
+	const delay = 50 * time.Millisecond
+	// Released during the first retry delay, like a previous process exiting
+	time.AfterFunc(delay/2, func() { busy.Close() })
+
+	cfg := &Config{BindRetries: 3, BindRetryDelay: delay}
+	l, err := listenRetry(cfg, addr)
+	if err != nil {
+		t.Fatalf("bind not retried: %v", err)
+	}
+	l.Close()
+
+	// Without retries the busy port fails at once
+	held, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	if _, err := listenRetry(&Config{}, addr); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("got %v, want EADDRINUSE", err)
+	}
+}
+
+// hang is a resolver that never answers
+func hang(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestLookupIP(t *testing.T) {
+	cfg := &Config{DNSTimeout: 20 * time.Millisecond, lookup: hang}
+	start := time.Now()
+	if _, err := lookupIP(cfg, "s"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("timeout fired after %v", d)
+	}
+	if n := cfg.stats.dnsTimeouts.Load(); n != 1 {
+		t.Errorf("got dnsTimeouts=%d, want 1", n)
+	}
+
+	// Other failures are not timeouts
+	cfg.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if _, err := lookupIP(cfg, "s"); err == nil {
+		t.Error("lookup did not fail")
+	}
+	if n := cfg.stats.dnsTimeouts.Load(); n != 1 {
+		t.Errorf("got dnsTimeouts=%d, want 1", n)
+	}
+
+	cfg.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+	}
+	ips, err := lookupIP(cfg, "s")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("got %v, %v", ips, err)
+	}
+}
+
+func TestDNSProbeBackoff(t *testing.T) {
+	h := captureLogs(t)
+	const period, maxBackoff = 20 * time.Millisecond, 80 * time.Millisecond
+	const failures = 5
+	var calls []time.Time
+	var mu sync.Mutex
+	done := make(chan struct{})
+	cfg := &Config{ProbePeriod: period, ProbeMaxBackoff: maxBackoff}
+	cfg.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		mu.Lock()
+		calls = append(calls, time.Now())
+		n := len(calls)
+		mu.Unlock()
+		switch {
+		case n <= failures:
+			return nil, errors.New("lookup failed")
+		case n == failures+2:
+			close(done)
+			select {} // stop probing
+		}
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+	}
+	go dnsProbe(cfg, "s")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("probe stuck")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Doubled on each failure up to the max, reset on recovery
+	want := []time.Duration{2 * period, 4 * period, maxBackoff, maxBackoff, maxBackoff, period}
+	for i, w := range want {
+		gap := calls[i+1].Sub(calls[i])
+		if gap < w || gap >= w+maxBackoff/2 {
+			t.Errorf("probe %d after %v, want %v", i+2, gap, w)
+		}
+	}
+	if n := h.count("Lookup failed"); n != 1 {
+		t.Errorf("got %d Lookup failed records, want 1", n)
+	}
+	i := h.find("Lookup recovered")
+	if i < 0 {
+		t.Fatal("recovery not logged")
+	}
+	if v, _ := h.attr(i, "failures"); v.Int64() != failures {
+		t.Errorf("got failures=%v, want %d", v, failures)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	cfg := &Config{SourceIP: net.ParseIP("127.0.0.1")}
+	if a, ok := cfg.dialer("tcp").LocalAddr.(*net.TCPAddr); !ok || !a.IP.Equal(cfg.SourceIP) || a.Port != 0 {
+		t.Errorf("got local address %v, want %v", cfg.dialer("tcp").LocalAddr, cfg.SourceIP)
+	}
+	if a := cfg.dialer("unix").LocalAddr; a != nil {
+		t.Errorf("got local address %v for unix", a)
+	}
+	if a := (&Config{}).dialer("tcp").LocalAddr; a != nil {
+		t.Errorf("got local address %v without a source IP", a)
+	}
+
+	// The backend sees the source IP
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg.SourceIP = net.ParseIP("127.0.0.2")
+	c, err := cfg.dialer("tcp").Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Skipf("127.0.0.2 not usable: %v", err)
+	}
+	defer c.Close()
+	if ip := c.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(cfg.SourceIP) {
+		t.Errorf("dialed from %v, want %v", ip, cfg.SourceIP)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const d = time.Second
+	for _, f := range []float64{0.1, 0.5} {
+		lo, hi := time.Duration(float64(d)*(1-f)), time.Duration(float64(d)*(1+f))
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 1000; i++ {
+			j := jitter(d, f)
+			if j < lo || j > hi {
+				t.Fatalf("jitter(%v, %v) = %v, out of [%v, %v]", d, f, j, lo, hi)
+			}
+			seen[j] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("jitter(%v, %v) does not vary", d, f)
+		}
+	}
+	if j := jitter(d, 0); j != d {
+		t.Errorf("got %v without jitter, want %v", j, d)
+	}
+}
+
+// startBackend serves each connection of a new loopback listener with handle
+func startBackend(t testing.TB, handle func(net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// forwardOnce connects a client forwarded to m, done is closed once
+// forward returns
+func forwardOnce(t testing.TB, cfg *Config, m *mapping) (client *net.TCPConn, done <-chan struct{}) {
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	conn, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c, err := front.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := make(chan struct{})
+	go func() {
+		forward(cfg, c, m)
+		close(d)
+	}()
+	return conn.(*net.TCPConn), d
+}
+
+func TestForwardCounts(t *testing.T) {
+	h := captureLogs(t)
+	const n, m = 1000, 3000
+	addr := startBackend(t, func(c net.Conn) {
+		io.ReadFull(c, make([]byte, n))
+		c.Write(make([]byte, m))
+	})
+	cfg := &Config{logs: newLogThrottle(0), penalties: newPenaltyBox(0)}
+	client, done := forwardOnce(t, cfg, &mapping{network: "tcp", static: []string{addr}})
+	client.Write(make([]byte, n))
+	reply, _ := io.ReadAll(client)
+	<-done
+
+	if len(reply) != m {
+		t.Errorf("client got %d bytes, want %d", len(reply), m)
+	}
+	i := h.find("Closed")
+	if i < 0 {
+		t.Fatal("no Closed record")
+	}
+	// From the LB point of view: received from the client, sent to it
+	if v, _ := h.attr(i, "received"); v.Int64() != n {
+		t.Errorf("got received=%v, want %d", v, n)
+	}
+	if v, _ := h.attr(i, "sent"); v.Int64() != m {
+		t.Errorf("got sent=%v, want %d", v, m)
+	}
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	// The backend only replies once the client is done sending
+	addr := startBackend(t, func(c net.Conn) {
+		io.ReadAll(c)
+		c.Write([]byte("pong"))
+	})
+	tests := []struct {
+		halfClose bool
+		reply     string
+	}{
+		{true, "pong"},
+		{false, ""}, // the backend side is closed with the client EOF
+	}
+	for _, tt := range tests {
+		t.Run("half-close="+strconv.FormatBool(tt.halfClose), func(t *testing.T) {
+			h := captureLogs(t)
+			cfg := &Config{HalfClose: tt.halfClose, logs: newLogThrottle(0), penalties: newPenaltyBox(0)}
+			client, done := forwardOnce(t, cfg, &mapping{network: "tcp", static: []string{addr}})
+			client.Write([]byte("ping"))
+			client.CloseWrite()
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			reply, _ := io.ReadAll(client)
+			<-done
+
+			if string(reply) != tt.reply {
+				t.Errorf("client got %q, want %q", reply, tt.reply)
+			}
+			i := h.find("Closed")
+			if i < 0 {
+				t.Fatal("no Closed record")
+			}
+			if v, _ := h.attr(i, "sent"); v.Int64() != int64(len(tt.reply)) {
+				t.Errorf("got sent=%v, want %d", v, len(tt.reply))
+			}
+			if v, _ := h.attr(i, "received"); v.Int64() != 4 {
+				t.Errorf("got received=%v, want 4", v)
+			}
+		})
+	}
+}
+
+// waitFor polls cond for up to a second
+func waitFor(t testing.TB, cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAcceptDenied(t *testing.T) {
+	addr := startBackend(t, func(c net.Conn) { c.Write([]byte("ok")) })
+	tests := []struct {
+		name    string
+		network string
+		opts    string
+		denied  bool
+	}{
+		{"tcp allowed", "tcp", ",allow=127.0.0.0/8", false},
+		{"tcp not allowed", "tcp", ",allow=10.0.0.0/8", true},
+		{"tcp denied", "tcp", ",deny=127.0.0.1", true},
+		{"unix without allow", "unix", ",deny=127.0.0.1", false},
+		{"unix with allow", "unix", ",allow=10.0.0.0/8", true}, // no client IP
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := captureLogs(t)
+			ms, err := parseMappings([]string{"1,static=" + addr + tt.opts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			laddr := "127.0.0.1:0"
+			if tt.network == "unix" {
+				laddr = t.TempDir() + "/lb.sock"
+			}
+			l, err := net.Listen(tt.network, laddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			cfg := &Config{logs: newLogThrottle(0), penalties: newPenaltyBox(0)}
+			acceptAndForward(cfg, l, &ms[0], nil)
+
+			client, err := net.Dial(tt.network, l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			reply, _ := io.ReadAll(client)
+			if tt.denied {
+				if len(reply) != 0 {
+					t.Errorf("denied client got %q", reply)
+				}
+				if !waitFor(t, func() bool { return h.find("Source not allowed, denied") >= 0 }) {
+					t.Error("denial not logged")
+				}
+			} else if string(reply) != "ok" {
+				t.Errorf("allowed client got %q", reply)
+			}
+		})
+	}
+}
+
+// serveMapping runs acceptAndForward for arg on a loopback listener
+func serveMapping(t testing.TB, cfg *Config, arg string, ready func() bool) string {
+	ms, err := parseMappings([]string{arg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	acceptAndForward(cfg, l, &ms[0], ready)
+	return l.Addr().String()
+}
+
+func TestQueue(t *testing.T) {
+	// The backend greets, then holds the connection until the client leaves
+	addr := startBackend(t, func(c net.Conn) {
+		c.Write([]byte("ok"))
+		io.Copy(io.Discard, c)
+	})
+	greeted := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 2)
+		_, err := io.ReadFull(c, buf)
+		return err == nil && string(buf) == "ok"
+	}
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		free     bool // first client leaves while the second waits
+		rejected bool
+	}{
+		{"freed slot", 2 * time.Second, true, false},
+		{"timeout", 50 * time.Millisecond, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := captureLogs(t)
+			cfg := &Config{logs: newLogThrottle(0), penalties: newPenaltyBox(0)}
+			front := serveMapping(t, cfg, "1,static="+addr+",max-listener-conns=1,queue-timeout="+tt.timeout.String(), nil)
+
+			first, err := net.Dial("tcp", front)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			if !greeted(first) {
+				t.Fatal("first client not served")
+			}
+			second, err := net.Dial("tcp", front)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Close()
+			if tt.free {
+				time.Sleep(20 * time.Millisecond) // let it queue
+				first.Close()
+			}
+			if got := greeted(second); got == tt.rejected {
+				t.Errorf("second client served=%v, want %v", got, !tt.rejected)
+			}
+			if !tt.rejected {
+				return
+			}
+			msg := "Too many connections, rejected after waiting"
+			if !waitFor(t, func() bool { return h.find(msg) >= 0 }) {
+				t.Fatal("rejection not logged")
+			}
+			if v, _ := h.attr(h.find(msg), "rejected"); v.Int64() != 1 {
+				t.Errorf("got rejected=%v, want 1", v)
+			}
+		})
+	}
+}
+
+func TestRecoverConn(t *testing.T) {
+	h := captureLogs(t)
+	cfg := &Config{}
+	c, _ := net.Pipe()
+	cleanups := 0
+	func() {
+		defer cfg.recoverConn("80", c, func() { cleanups++ })
+		panic("boom")
+	}()
+	if n := cfg.stats.panics.Load(); n != 1 {
+		t.Errorf("got panics=%d, want 1", n)
+	}
+	if cleanups != 1 {
+		t.Errorf("cleanup called %d times, want 1", cleanups)
+	}
+	if h.find("Panic while forwarding") < 0 {
+		t.Error("panic not logged")
+	}
+
+	// Nothing happens without a panic, a nil cleanup is fine
+	func() {
+		defer cfg.recoverConn("80", c, func() { cleanups++ })
+	}()
+	func() {
+		defer cfg.recoverConn("80", c, nil)
+		panic("boom")
+	}()
+	if n := cfg.stats.panics.Load(); n != 2 || cleanups != 1 {
+		t.Errorf("got panics=%d cleanups=%d, want 2 and 1", n, cleanups)
+	}
+}
+
+func TestWaitResolved(t *testing.T) {
+	addr := startBackend(t, func(c net.Conn) { c.Write([]byte("ok")) })
+	tests := []struct {
+		name      string
+		resolveIn time.Duration // 0 never resolves
+		wait      time.Duration
+		resolved  bool
+		notBefore time.Duration // no reply before
+	}{
+		{"resolved", 300 * time.Millisecond, 5 * time.Second, true, 300 * time.Millisecond},
+		{"timeout", 0, 300 * time.Millisecond, false, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := captureLogs(t)
+			start := time.Now()
+			cfg := &Config{logs: newLogThrottle(0), penalties: newPenaltyBox(0)}
+			cfg.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+				if tt.resolveIn == 0 || time.Since(start) < tt.resolveIn {
+					return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+				}
+				return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+			}
+			var resolved atomic.Bool
+			ready := func() bool {
+				ok := waitResolved(cfg, "s", tt.wait)
+				resolved.Store(ok)
+				return ok
+			}
+			front := serveMapping(t, cfg, "1,static="+addr, ready)
+
+			// The client waits in the listen backlog until the listener is ready
+			client, err := net.Dial("tcp", front)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply, _ := io.ReadAll(client)
+			if string(reply) != "ok" {
+				t.Fatalf("got %q, want ok", reply)
+			}
+			if d := time.Since(start); d < tt.notBefore {
+				t.Errorf("accepted after %v, before %v", d, tt.notBefore)
+			}
+			if resolved.Load() != tt.resolved {
+				t.Errorf("got resolved=%v, want %v", resolved.Load(), tt.resolved)
+			}
+			if got := h.find("Host not resolved in time, starting anyway") >= 0; got == tt.resolved {
+				t.Errorf("timeout logged=%v", got)
+			}
+		})
+	}
+}
+
+// BenchmarkForward measures the allocations of a forwarded TCP connection.
+// They do not grow with the payload: both ends being TCP, io.Copy splices
+// between the sockets without a user space buffer.
+func BenchmarkForward(b *testing.B) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer front.Close()
+
+	cfg := &Config{logs: newLogThrottle(time.Second), penalties: newPenaltyBox(0)}
+	m := &mapping{network: "tcp", static: []string{backend.Addr().String()}}
+	for _, size := range []int{1 << 10, 1 << 20} {
+		payload := make([]byte, size)
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				client, err := net.Dial("tcp", front.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				c, err := front.Accept()
+				if err != nil {
+					b.Fatal(err)
+				}
+				done := make(chan struct{})
+				go func() {
+					forward(cfg, c, m)
+					close(done)
+				}()
+				client.Write(payload)
+				client.(*net.TCPConn).CloseWrite()
+				io.Copy(io.Discard, client)
+				client.Close()
+				<-done
+			}
+		})
+	}
+}
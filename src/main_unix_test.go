@@ -0,0 +1,121 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt reads an int socket option of c
+func sockopt(t *testing.T, c *net.TCPConn, level, opt int) int {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := rc.Control(func(fd uintptr) { v, serr = syscall.GetsockoptInt(int(fd), level, opt) }); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestSetTCPOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := conn.(*net.TCPConn)
+
+	tests := []struct {
+		noDelay   bool
+		keepAlive time.Duration
+	}{
+		{true, 15 * time.Second},
+		{false, 0},
+		{true, 0},
+		{false, time.Second},
+	}
+	for _, tt := range tests {
+		setTCPOptions(&Config{TCPNoDelay: tt.noDelay, TCPKeepAlive: tt.keepAlive}, c)
+		if got := sockopt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0; got != tt.noDelay {
+			t.Errorf("%+v: got TCP_NODELAY=%v", tt, got)
+		}
+		if got := sockopt(t, c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0; got != (tt.keepAlive > 0) {
+			t.Errorf("%+v: got SO_KEEPALIVE=%v", tt, got)
+		}
+	}
+
+	// Other connections are left alone
+	p, _ := net.Pipe()
+	setTCPOptions(&Config{TCPNoDelay: true}, p)
+}
+
+func TestInheritListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// A pre-opened socket, as passed by a parent process
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// inheritListener takes over the fd it is given
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherited, err := inheritListener(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			c.Write([]byte("hi"))
+			c.Close()
+		}
+	}()
+	c, err := inherited.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got, _ := io.ReadAll(c); string(got) != "hi" {
+		t.Errorf("got %q through the inherited listener", got)
+	}
+
+	// Not a socket
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fd, err = syscall.Dup(int(r.Fd()))
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inheritListener(fd); err == nil {
+		t.Error("pipe inherited as a listener")
+	}
+}
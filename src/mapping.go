@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mapping is a parsed <[bind:]porti:host:port[,option...]> argument
+type mapping struct {
+	bind    string // listen on all interfaces when empty
+	listen  string
+	fd      int    // inherited listening socket, 0 to bind
+	network string // "tcp" or "unix"
+	host    string // socket path for unix, empty for static backends
+	port    string
+	static  []string // fixed backend addresses or unix:path, no DNS probe
+
+	maxConns     int           // max concurrent connections on the listener, 0 for no limit
+	queueTimeout time.Duration // how long a connection may wait for a slot, 0 to reject at once
+	queueSize    int           // max connections waiting for a slot
+
+	allow []*net.IPNet // only these sources are accepted when not empty
+	deny  []*net.IPNet
+
+	rate  float64 // new connections per second per source IP, 0 for no limit
+	burst int
+
+	listens []string // more listen ports sharing this mapping, expanded by parseMapping
+}
+
+func (m mapping) listenAddr() string {
+	return net.JoinHostPort(m.bind, m.listen)
+}
+
+func (m mapping) addr() string {
+	if m.network == "unix" {
+		return m.host
+	}
+	return m.host + ":" + m.port
+}
+
+// backend returns the address to dial for a new connection, skipping the
+// static backends in the penalty box unless they all are
+func (m mapping) backend(p *penaltyBox) string {
+	switch len(m.static) {
+	case 0:
+		return m.addr()
+	case 1:
+		return m.static[0]
+	}
+	now := time.Now()
+	candidates := make([]string, 0, len(m.static))
+	for _, addr := range m.static {
+		if !p.penalized(addr, now) {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = m.static
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// dialArgs returns the network and address to dial for a backend
+func (m mapping) dialArgs(addr string) (string, string) {
+	if len(m.static) > 0 {
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			return "unix", path
+		}
+	}
+	return m.network, addr
+}
+
+func (m mapping) String() string {
+	if m.network == "unix" {
+		return "unix:" + m.host
+	}
+	if len(m.static) > 0 {
+		return "static=" + strings.Join(m.static, ";")
+	}
+	return m.addr()
+}
+
+// allowed checks the source IP against the allow and deny lists, deny first.
+// An unknown (nil) IP, e.g. of a unix socket client, is only allowed
+// without an allow list.
+func (m mapping) allowed(ip net.IP) bool {
+	for _, n := range m.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(m.allow) == 0 {
+		return true
+	}
+	for _, n := range m.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a ';' separated list of CIDRs or single IPs
+func parseCIDRs(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(value, ";") {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func checkPort(port string) error {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// parseListen parses a <[bind:]port[;port...]> listen address
+func (m *mapping) parseListen(listen string) error {
+	if strings.Contains(listen, ":") {
+		bind, port, err := net.SplitHostPort(listen)
+		if err != nil {
+			return fmt.Errorf("listen address: %w", err)
+		}
+		if net.ParseIP(bind) == nil {
+			return fmt.Errorf("listen address: invalid bind IP %q", bind)
+		}
+		m.bind = bind
+		listen = port
+	}
+	ports := strings.Split(listen, ";")
+	seen := make(map[string]bool)
+	for _, port := range ports {
+		if err := checkPort(port); err != nil {
+			return fmt.Errorf("listen port: %w", err)
+		}
+		if seen[port] {
+			return fmt.Errorf("listen port: duplicate port %q", port)
+		}
+		seen[port] = true
+	}
+	m.listen = ports[0]
+	m.listens = ports[1:]
+	return nil
+}
+
+// parseSpec parses the part of the argument before the options. When the
+// backends are given by an option, the spec is only the listen address.
+func parseSpec(spec string, listenOnly bool) (mapping, error) {
+	m := mapping{network: "tcp"}
+	if listenOnly {
+		if err := m.parseListen(spec); err != nil {
+			return m, fmt.Errorf("expected [bind:]porti with static backends: %w", err)
+		}
+		return m, nil
+	}
+
+	// Only an absolute path, so that a host named unix still works
+	if listen, path, ok := strings.Cut(spec, ":unix:"); ok && strings.HasPrefix(path, "/") {
+		m.network = "unix"
+		m.host = path
+		return m, m.parseListen(listen)
+	}
+
+	mappings := strings.Split(spec, ":")
+	var listen string
+	if len(mappings) >= 3 {
+		listen = strings.Join(mappings[:len(mappings)-2], ":")
+		m.host = mappings[len(mappings)-2]
+		m.port = mappings[len(mappings)-1]
+	} else if len(mappings) == 2 {
+		listen = mappings[1]
+		m.host = mappings[0]
+		m.port = mappings[1]
+		if strings.Contains(m.port, ";") {
+			return m, errors.New("several listen ports need the porti:host:port format")
+		}
+	} else {
+		return m, errors.New("not in [bind:]porti:host:port or host:port format")
+	}
+
+	if err := m.parseListen(listen); err != nil {
+		return m, err
+	}
+	if m.host == "" {
+		return m, errors.New("empty host")
+	}
+	if err := checkPort(m.port); err != nil {
+		return m, fmt.Errorf("target port: %w", err)
+	}
+	return m, nil
+}
+
+func (m *mapping) setOption(opt string) error {
+	key, value, _ := strings.Cut(opt, "=")
+	switch key {
+	case "static":
+		for _, b := range strings.Split(value, ";") {
+			if path, ok := strings.CutPrefix(b, "unix:"); ok {
+				if !strings.HasPrefix(path, "/") {
+					return fmt.Errorf("static: socket path %q is not absolute", path)
+				}
+				m.static = append(m.static, b)
+				continue
+			}
+			host, port, err := net.SplitHostPort(b)
+			if err != nil {
+				host = b
+				port = m.listen
+			}
+			if net.ParseIP(host) == nil {
+				return fmt.Errorf("static: invalid IP %q", host)
+			}
+			if err := checkPort(port); err != nil {
+				return fmt.Errorf("static: %w", err)
+			}
+			m.static = append(m.static, net.JoinHostPort(host, port))
+		}
+	case "max-listener-conns":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("max-listener-conns: invalid value %q", value)
+		}
+		m.maxConns = n
+	case "fd":
+		fd, err := strconv.Atoi(value)
+		if err != nil || fd < 3 {
+			return fmt.Errorf("fd: invalid file descriptor %q", value)
+		}
+		m.fd = fd
+	case "queue-timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("queue-timeout: invalid duration %q", value)
+		}
+		m.queueTimeout = d
+	case "queue-size":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("queue-size: invalid value %q", value)
+		}
+		m.queueSize = n
+	case "rate":
+		r, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(r > 0) || math.IsInf(r, 1) {
+			return fmt.Errorf("rate: invalid value %q", value)
+		}
+		m.rate = r
+	case "burst":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("burst: invalid value %q", value)
+		}
+		m.burst = n
+	case "allow", "deny":
+		nets, err := parseCIDRs(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if key == "allow" {
+			m.allow = append(m.allow, nets...)
+		} else {
+			m.deny = append(m.deny, nets...)
+		}
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	return nil
+}
+
+// parseMapping returns one mapping per listen port
+func parseMapping(arg string) ([]mapping, error) {
+	spec, opts, _ := strings.Cut(arg, ",")
+	var options []string
+	if opts != "" {
+		options = strings.Split(opts, ",")
+	}
+	listenOnly := false
+	for _, opt := range options {
+		if strings.HasPrefix(opt, "static=") {
+			listenOnly = true
+		}
+	}
+
+	m, err := parseSpec(spec, listenOnly)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", arg, err)
+	}
+
+	// Options are applied per listen port, as some default to it
+	ports := append([]string{m.listen}, m.listens...)
+	m.listens = nil
+	var ms []mapping
+	for _, port := range ports {
+		o := m
+		o.listen = port
+		for _, opt := range options {
+			if err := o.setOption(opt); err != nil {
+				return nil, fmt.Errorf("%q: %w", arg, err)
+			}
+		}
+		if o.fd > 0 && len(ports) > 1 {
+			return nil, fmt.Errorf("%q: fd needs a single listen port", arg)
+		}
+		if o.rate > 0 && o.burst == 0 {
+			o.burst = max(1, int(math.Ceil(o.rate)))
+		}
+		if o.queueTimeout > 0 {
+			if o.maxConns == 0 {
+				return nil, fmt.Errorf("%q: queue-timeout needs max-listener-conns", arg)
+			}
+			if o.queueSize == 0 {
+				o.queueSize = o.maxConns
+			}
+		}
+		ms = append(ms, o)
+	}
+	return ms, nil
+}
+
+// parseMappings parses and validates all the arguments, without any side effect.
+// All the errors are reported at once.
+func parseMappings(args []string) ([]mapping, error) {
+	var ms []mapping
+	var errs []error
+	fds := make(map[int]int) // inherited fd -> arg
+	for i, arg := range args {
+		m, err := parseMapping(arg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("arg %d: %w", i, err))
+			continue
+		}
+		if fd := m[0].fd; fd > 0 {
+			if j, ok := fds[fd]; ok {
+				errs = append(errs, fmt.Errorf("arg %d: %q: fd %d already used by arg %d", i, arg, fd, j))
+				continue
+			}
+			fds[fd] = i
+		}
+		ms = append(ms, m...)
+	}
+	return ms, errors.Join(errs...)
+}
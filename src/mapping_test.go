@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMappings(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string // "listenAddr -> target" per listener
+		err  string   // expected error substring, empty for none
+	}{
+		{name: "porti:host:port", args: []string{"8080:service1:8081"}, want: []string{":8080 -> service1:8081"}},
+		{name: "host:port", args: []string{"service1:8081"}, want: []string{":8081 -> service1:8081"}},
+		{name: "bind IPv4", args: []string{"127.0.0.1:8080:service1:8081"}, want: []string{"127.0.0.1:8080 -> service1:8081"}},
+		{name: "bind IPv6", args: []string{"[::1]:8080:service1:8081"}, want: []string{"[::1]:8080 -> service1:8081"}},
+		{name: "bind not an IP", args: []string{"foo:8080:service1:8081"}, err: "invalid bind IP"},
+		{name: "port list", args: []string{"80;8080:service1:8081"}, want: []string{":80 -> service1:8081", ":8080 -> service1:8081"}},
+		{name: "port list with bind", args: []string{"127.0.0.1:80;81:s:1"}, want: []string{"127.0.0.1:80 -> s:1", "127.0.0.1:81 -> s:1"}},
+		{name: "duplicate port", args: []string{"80;80:s:1"}, err: `duplicate port "80"`},
+		{name: "duplicate port static", args: []string{"80;81;80,static=10.0.0.1"}, err: `duplicate port "80"`},
+		{name: "port list host:port", args: []string{"s:80;81"}, err: "several listen ports"},
+		{name: "unix", args: []string{"8080:unix:/var/run/s.sock"}, want: []string{":8080 -> unix:/var/run/s.sock"}},
+		{name: "unix with bind", args: []string{"127.0.0.1:8080:unix:/s.sock"}, want: []string{"127.0.0.1:8080 -> unix:/s.sock"}},
+		{name: "unix empty path", args: []string{"8080:unix:"}, err: "target port"},
+		{name: "host named unix", args: []string{"8080:unix:80"}, want: []string{":8080 -> unix:80"}},
+		{name: "static", args: []string{"8080,static=10.0.0.1;10.0.0.2:9000"}, want: []string{":8080 -> static=10.0.0.1:8080;10.0.0.2:9000"}},
+		{name: "static default port per listen port", args: []string{"80;81,static=10.0.0.1"}, want: []string{":80 -> static=10.0.0.1:80", ":81 -> static=10.0.0.1:81"}},
+		{name: "static unix", args: []string{"8080,static=unix:/a.sock;10.0.0.1"}, want: []string{":8080 -> static=unix:/a.sock;10.0.0.1:8080"}},
+		{name: "static unix empty path", args: []string{"8080,static=unix:"}, err: "is not absolute"},
+		{name: "static unix relative path", args: []string{"8080,static=unix:a.sock"}, err: "is not absolute"},
+		{name: "static with host", args: []string{"80:s:1,static=10.0.0.1"}, err: "expected [bind:]porti with static backends"},
+		{name: "static not an IP", args: []string{"80,static=foo"}, err: `invalid IP "foo"`},
+		{name: "no backend", args: []string{"80"}, err: "not in [bind:]porti:host:port"},
+		{name: "invalid target port", args: []string{"80:s:0"}, err: "target port"},
+		{name: "unknown option", args: []string{"80:s:1,foo=1"}, err: `unknown option "foo"`},
+		{name: "fd", args: []string{"80:s:1,fd=3", "81:s:1,fd=4"}, want: []string{":80 -> s:1", ":81 -> s:1"}},
+		{name: "fd with several ports", args: []string{"80;81:s:1,fd=3"}, err: "fd needs a single listen port"},
+		{name: "duplicate fd", args: []string{"80:s:1,fd=3", "81:s:1,fd=3"}, err: "fd 3 already used by arg 0"},
+		{name: "rate", args: []string{"80:s:1,rate=0.5"}, want: []string{":80 -> s:1"}},
+		{name: "rate zero", args: []string{"80:s:1,rate=0"}, err: `rate: invalid value "0"`},
+		{name: "rate NaN", args: []string{"80:s:1,rate=NaN"}, err: `rate: invalid value "NaN"`},
+		{name: "rate Inf", args: []string{"80:s:1,rate=Inf"}, err: `rate: invalid value "Inf"`},
+		{name: "queue-timeout without cap", args: []string{"80:s:1,queue-timeout=1s"}, err: "queue-timeout needs max-listener-conns"},
+		{name: "queue-timeout with cap", args: []string{"80:s:1,max-listener-conns=2,queue-timeout=1s"}, want: []string{":80 -> s:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms, err := parseMappings(tt.args)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range ms {
+				got = append(got, m.listenAddr()+" -> "+m.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialArgs(t *testing.T) {
+	ms, err := parseMappings([]string{"8080,static=unix:/a.sock;10.0.0.1", "8081:s:9000", "8082:unix:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		m                      mapping
+		addr, network, address string
+	}{
+		{ms[0], "unix:/a.sock", "unix", "/a.sock"},
+		{ms[0], "10.0.0.1:8080", "tcp", "10.0.0.1:8080"},
+		{ms[1], "s:9000", "tcp", "s:9000"},
+		{ms[2], ms[2].addr(), "tcp", "unix:80"}, // host named unix
+	} {
+		network, address := tt.m.dialArgs(tt.addr)
+		if network != tt.network || address != tt.address {
+			t.Errorf("dialArgs(%q) = %s %s, want %s %s", tt.addr, network, address, tt.network, tt.address)
+		}
+	}
+}
+
+func TestParseMappingsOptions(t *testing.T) {
+	ms, err := parseMappings([]string{"80:s:1,max-listener-conns=4,queue-timeout=2s,rate=2.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ms[0]
+	if m.maxConns != 4 || m.queueTimeout != 2*time.Second || m.queueSize != 4 {
+		t.Errorf("got maxConns=%d queueTimeout=%v queueSize=%d", m.maxConns, m.queueTimeout, m.queueSize)
+	}
+	if m.rate != 2.5 || m.burst != 3 {
+		t.Errorf("got rate=%v burst=%d, want burst defaulting to ceil(rate)", m.rate, m.burst)
+	}
+}
+
+func TestParseMappingsAggregatesErrors(t *testing.T) {
+	_, err := parseMappings([]string{"80:s:0", "8080:s:1", "a:b:c:d", "80,static=foo"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) {
+		t.Fatalf("expected joined errors, got %T", err)
+	}
+	errs := joined.Unwrap()
+	if len(errs) != 3 {
+		t.Fatalf("got %d errors, want 3: %v", len(errs), err)
+	}
+	for i, prefix := range []string{"arg 0:", "arg 2:", "arg 3:"} {
+		if !strings.HasPrefix(errs[i].Error(), prefix) {
+			t.Errorf("error %d = %q, want prefix %q", i, errs[i], prefix)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs("10.0.0.0/8;192.168.1.1;::1;fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "::1/128", "fd00::/8"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, bad := range []string{"", "10.0.0.0/33", "foo", "10.0.0.1;"} {
+		if _, err := parseCIDRs(bad); err == nil {
+			t.Errorf("parseCIDRs(%q) did not fail", bad)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		opts string
+		ip   string // empty for an unknown IP
+		want bool
+	}{
+		{"", "10.1.2.3", true},
+		{"", "", true},
+		{",allow=10.0.0.0/8", "10.1.2.3", true},
+		{",allow=10.0.0.0/8", "192.168.1.1", false},
+		{",allow=10.0.0.0/8", "::ffff:10.1.2.3", true},
+		{",allow=10.0.0.0/8", "", false},
+		{",deny=10.0.0.0/8", "10.1.2.3", false},
+		{",deny=10.0.0.0/8", "192.168.1.1", true},
+		{",deny=10.0.0.0/8", "", true},
+		{",allow=10.0.0.0/8,deny=10.0.0.1", "10.0.0.1", false},
+		{",allow=10.0.0.0/8,deny=10.0.0.1", "10.0.0.2", true},
+	}
+	for _, tt := range tests {
+		ms, err := parseMappings([]string{"80:s:1" + tt.opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ip net.IP
+		if tt.ip != "" {
+			ip = net.ParseIP(tt.ip)
+		}
+		if got := ms[0].allowed(ip); got != tt.want {
+			t.Errorf("%s: allowed(%q) = %v, want %v", tt.opts, tt.ip, got, tt.want)
+		}
+	}
+}
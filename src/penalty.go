@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// penaltyBox remembers the backends that just failed to dial, so that they
+// are not selected again before the cooldown, e.g. while DNS catches up
+type penaltyBox struct {
+	cooldown time.Duration // 0 disables the penalty
+
+	mu          sync.Mutex
+	lastFailure map[string]time.Time
+}
+
+func newPenaltyBox(cooldown time.Duration) *penaltyBox {
+	return &penaltyBox{cooldown: cooldown, lastFailure: make(map[string]time.Time)}
+}
+
+func (p *penaltyBox) fail(addr string) {
+	if p.cooldown <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastFailure[addr] = time.Now()
+}
+
+func (p *penaltyBox) penalized(addr string, now time.Time) bool {
+	if p.cooldown <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last, ok := p.lastFailure[addr]
+	if !ok {
+		return false
+	}
+	if now.Sub(last) >= p.cooldown {
+		delete(p.lastFailure, addr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPenaltyBox(t *testing.T) {
+	p := newPenaltyBox(time.Second)
+	p.fail("a")
+	now := time.Now()
+	if !p.penalized("a", now) {
+		t.Error("just failed backend not penalized")
+	}
+	if p.penalized("b", now) {
+		t.Error("other backend penalized")
+	}
+	if p.penalized("a", now.Add(time.Second)) {
+		t.Error("backend still penalized after the cooldown")
+	}
+	if len(p.lastFailure) != 0 {
+		t.Error("expired penalty not pruned")
+	}
+
+	p = newPenaltyBox(0)
+	p.fail("a")
+	if p.penalized("a", time.Now()) {
+		t.Error("backend penalized with the cooldown disabled")
+	}
+}
+
+func TestBackendSkipsPenalized(t *testing.T) {
+	m := mapping{network: "tcp", static: []string{"10.0.0.1:80", "10.0.0.2:80"}}
+	p := newPenaltyBox(time.Minute)
+	p.fail("10.0.0.1:80")
+	for i := 0; i < 100; i++ {
+		if addr := m.backend(p); addr != "10.0.0.2:80" {
+			t.Fatalf("got %s within the cooldown", addr)
+		}
+	}
+
+	// All failing, pick any rather than none
+	p.fail("10.0.0.2:80")
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[m.backend(p)] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("got %v, want both backends when all are penalized", seen)
+	}
+}
+
+// BenchmarkBackend measures the selection of a backend: a single static
+// backend takes the fast path, several go through the penalty box.
+func BenchmarkBackend(b *testing.B) {
+	for _, n := range []int{1, 2, 8} {
+		m := mapping{network: "tcp"}
+		for i := 0; i < n; i++ {
+			m.static = append(m.static, "10.0.0."+strconv.Itoa(i+1)+":80")
+		}
+		p := newPenaltyBox(time.Minute)
+		p.fail(m.static[0])
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.backend(p)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxRateSources bounds the number of sources tracked by a rate limiter,
+// the least recently seen ones are forgotten first
+const maxRateSources = 10000
+
+// rateLimiter is a token bucket per source
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	size  int
+
+	mu      sync.Mutex
+	lru     *list.List // of *bucket, most recent first
+	buckets map[string]*list.Element
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, size int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		size:    size,
+		lru:     list.New(),
+		buckets: make(map[string]*list.Element),
+	}
+}
+
+// allow takes a token from the bucket of key, if any
+func (r *rateLimiter) allow(key string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.buckets[key]
+	if !ok {
+		if r.lru.Len() >= r.size {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.buckets, oldest.Value.(*bucket).key)
+		}
+		e = r.lru.PushFront(&bucket{key: key, tokens: r.burst, last: now})
+		r.buckets[key] = e
+	} else {
+		r.lru.MoveToFront(e)
+	}
+
+	b := e.Value.(*bucket)
+	b.tokens = min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
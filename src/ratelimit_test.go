@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterPerSource(t *testing.T) {
+	r := newRateLimiter(1, 2, maxRateSources)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if !r.allow("10.0.0.1", now) {
+			t.Fatalf("connection %d rejected within the burst", i)
+		}
+	}
+	if r.allow("10.0.0.1", now) {
+		t.Error("connection allowed over the burst")
+	}
+	if !r.allow("10.0.0.2", now) {
+		t.Error("another source throttled")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	r := newRateLimiter(2, 1, maxRateSources)
+	now := time.Now()
+	if !r.allow("a", now) {
+		t.Fatal("first connection rejected")
+	}
+	if r.allow("a", now.Add(100*time.Millisecond)) {
+		t.Error("allowed before a token was refilled")
+	}
+	if !r.allow("a", now.Add(600*time.Millisecond)) {
+		t.Error("rejected after a token was refilled")
+	}
+	// Tokens do not pile up over the burst while idle
+	later := now.Add(time.Hour)
+	if !r.allow("a", later) {
+		t.Fatal("rejected after a long idle time")
+	}
+	if r.allow("a", later) {
+		t.Error("allowed over the burst after a long idle time")
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	r := newRateLimiter(1, 1, 2)
+	now := time.Now()
+	r.allow("a", now)
+	r.allow("b", now)
+	r.allow("a", now) // a is now the most recent, b the oldest
+	r.allow("c", now)
+	if len(r.buckets) != 2 || r.lru.Len() != 2 {
+		t.Fatalf("got %d buckets and %d lru entries, want 2", len(r.buckets), r.lru.Len())
+	}
+	if _, ok := r.buckets["b"]; ok {
+		t.Error("least recently seen source not evicted")
+	}
+	if r.allow("a", now) {
+		t.Error("a forgotten instead of b")
+	}
+	// b starts over with a full bucket
+	if !r.allow("b", now) {
+		t.Error("evicted source still throttled")
+	}
+}
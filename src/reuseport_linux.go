@@ -0,0 +1,6 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+// SO_REUSEPORT, missing from the syscall package on most Linux architectures
+const soReusePort = 0xf
@@ -0,0 +1,34 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+// TestReusePort binds the same port twice, which only works when
+// soReusePort really is SO_REUSEPORT
+func TestReusePort(t *testing.T) {
+	cfg := &Config{ReusePort: true}
+	l1, err := listen(cfg, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	addr := l1.Addr().String()
+
+	l2, err := listen(cfg, addr)
+	if err != nil {
+		t.Fatalf("second bind with SO_REUSEPORT: %v", err)
+	}
+	l2.Close()
+
+	if l3, err := listen(&Config{}, addr); !errors.Is(err, syscall.EADDRINUSE) {
+		if err == nil {
+			l3.Close()
+		}
+		t.Errorf("second bind without SO_REUSEPORT: got %v, want EADDRINUSE", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !((linux && !mips && !mipsle && !mips64 && !mips64le) || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"log/slog"
+	"syscall"
+)
+
+// reusePort is not supported on this platform, the port is bound as usual
+func reusePort(network, address string, c syscall.RawConn) error {
+	slog.Warn("SO_REUSEPORT is not supported on this platform, ignored", "addr", address)
+	return nil
+}